@@ -0,0 +1,193 @@
+// Package compression implements the pluggable codecs usable for a
+// selfextract payload: the archive records which one was used in a single
+// tag byte, and the extractor can also sniff it from the payload's magic
+// bytes when reading archives that predate the tag.
+package compression
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Codec compresses and decompresses a selfextract payload stream.
+type Codec interface {
+	// Name is the value accepted by create's -z flag.
+	Name() string
+	// Tag is the single byte written to the archive trailer to record which
+	// codec produced the payload.
+	Tag() byte
+	NewWriter(w io.Writer, level int) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	Zstd = zstdCodec{}
+	Gzip = gzipCodec{}
+	Xz   = xzCodec{}
+	None = noneCodec{}
+
+	// byName holds every codec selectable through create's -z flag. bzip2 is
+	// intentionally absent: compress/bzip2 only implements a reader, so it
+	// can be detected but never produced.
+	byName = map[string]Codec{
+		Zstd.Name(): Zstd,
+		Gzip.Name(): Gzip,
+		Xz.Name():   Xz,
+		None.Name(): None,
+	}
+
+	byTag = map[byte]Codec{
+		Zstd.Tag(): Zstd,
+		Gzip.Tag(): Gzip,
+		Xz.Tag():   Xz,
+		None.Tag(): None,
+	}
+)
+
+// ByName returns the codec registered under name, for create's -z flag.
+func ByName(name string) (Codec, error) {
+	c, ok := byName[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q", name)
+	}
+	return c, nil
+}
+
+// ByTag returns the codec a trailer tag byte refers to.
+func ByTag(tag byte) (Codec, error) {
+	c, ok := byTag[tag]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression tag %#x", tag)
+	}
+	return c, nil
+}
+
+// magics are the codec detection signatures used by Docker/containerd's
+// DetectCompression. None is a prefix of another, so their order doesn't
+// matter.
+var magics = []struct {
+	codec Codec
+	magic []byte
+}{
+	{Zstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{Gzip, []byte{0x1f, 0x8b, 0x08}},
+	{Xz, []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}},
+	{bzip2Codec{}, []byte{0x42, 0x5a, 0x68}},
+}
+
+// Detect sniffs the codec from the leading bytes of a payload, for archives
+// that predate the trailer's codec tag. It returns None when nothing matches,
+// i.e. the payload is assumed to be an uncompressed tar.
+func Detect(head []byte) Codec {
+	for _, m := range magics {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.codec
+		}
+	}
+	return None
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return "zstd" }
+func (zstdCodec) Tag() byte    { return 'z' }
+
+func (zstdCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstdLevel(level)))
+}
+
+// zstdLevel maps the -L flag's generic 0..4 scale onto zstd's small set of
+// named speed/ratio tradeoffs, since zstd doesn't expose per-integer levels
+// the way gzip does. 0 (the flag's default) keeps the previous hardcoded
+// behavior of always using the fastest preset.
+func zstdLevel(level int) zstd.EncoderLevel {
+	switch {
+	case level <= 1:
+		return zstd.SpeedFastest
+	case level == 2:
+		return zstd.SpeedDefault
+	case level == 3:
+		return zstd.SpeedBetterCompression
+	default:
+		return zstd.SpeedBestCompression
+	}
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	zRdr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return zRdr.IOReadCloser(), nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+func (gzipCodec) Tag() byte    { return 'g' }
+
+func (gzipCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type xzCodec struct{}
+
+func (xzCodec) Name() string { return "xz" }
+func (xzCodec) Tag() byte    { return 'x' }
+
+func (xzCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return xz.NewWriter(w)
+}
+
+func (xzCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	xRdr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(xRdr), nil
+}
+
+// bzip2Codec is only used for detection: compress/bzip2 has no writer, so it
+// is never registered in byName or byTag.
+type bzip2Codec struct{}
+
+func (bzip2Codec) Name() string { return "bzip2" }
+func (bzip2Codec) Tag() byte    { return 'b' }
+
+func (bzip2Codec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("bzip2: compression not supported, read-only")
+}
+
+func (bzip2Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(bzip2.NewReader(r)), nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string { return "none" }
+func (noneCodec) Tag() byte    { return 'n' }
+
+func (noneCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
@@ -5,13 +5,22 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/klauspost/compress/zstd"
+	"github.com/moby/patternmatcher"
+
+	"github.com/synthesio/selfextract/compression"
+	"github.com/synthesio/selfextract/encryption"
+	"github.com/synthesio/selfextract/idmap"
 )
 
-func create(stub, key []byte, out string, files []string, cd string) {
-	if len(files) == 0 {
+func create(stub, key []byte, out string, files []string, cd string, codec compression.Codec, level int, uidMap, gidMap idmap.Map, password string, includes, excludes []string, manifest, baseArchive string) {
+	if len(files) == 0 && manifest == "" {
 		die("no files to archive")
 	}
 
@@ -24,23 +33,46 @@ func create(stub, key []byte, out string, files []string, cd string) {
 	if err != nil {
 		die("writing stub to output file:", err)
 	}
+	payloadOffset := int64(len(stub))
+
+	newKey := generateRandomKey()
 
-	_, err = f.Write(generateBoundary())
+	wrappedKey, err := encryption.WrapKey(newKey, password)
 	if err != nil {
-		die("writing boundary to output file:", err)
+		die("wrapping payload key:", err)
+	}
+	payloadKey, err := encryption.DeriveKey(wrappedKey)
+	if err != nil {
+		die("deriving payload key:", err)
+	}
+	encWrt, err := encryption.NewWriter(f, payloadKey)
+	if err != nil {
+		die("creating payload encryption:", err)
 	}
 
-	_, err = f.Write(generateRandomKey())
+	cWrt, err := codec.NewWriter(encWrt, level)
 	if err != nil {
-		die("writing key to output file:", err)
+		die("creating", codec.Name(), "compressor:", err)
 	}
 
-	zWrt, err := zstd.NewWriter(f, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	tarWrt := tar.NewWriter(cWrt)
+
+	matcher, err := buildMatcher(includes, excludes)
 	if err != nil {
-		die("creating zstd compressor:", err)
+		die("building include/exclude matcher:", err)
 	}
 
-	tarWrt := tar.NewWriter(zWrt)
+	var parentKey []byte
+	var baseEntries map[string]baseEntry
+	var seen map[string]bool
+	if baseArchive != "" {
+		parentKey, baseEntries, err = readBaseArchive(baseArchive, password)
+		if err != nil {
+			die("reading base archive:", err)
+		}
+		debug("diffing against base archive,", len(baseEntries), "entries")
+		seen = map[string]bool{}
+	}
 
 	for _, file := range files {
 		rootDir := os.DirFS(cd)
@@ -53,63 +85,82 @@ func create(stub, key []byte, out string, files []string, cd string) {
 			if path == "." {
 				return nil
 			}
-			debug("archiving", path)
-
-			var hdr tar.Header
-			hdr.Name = path
 
-			info, err := d.Info()
-			if err != nil {
-				die("getting info about file:", path)
-			}
-			mode := info.Mode()
-			hdr.Mode = int64(mode)
-
-			switch mode.Type() {
-			case fs.ModeDir:
-				hdr.Typeflag = tar.TypeDir
-			case fs.ModeSymlink:
-				hdr.Typeflag = tar.TypeSymlink
-				target, err := os.Readlink(filepath.Join(cd, path))
+			if matcher != nil {
+				matched, err := matcher.Matches(path)
 				if err != nil {
-					die("getting target of symlink:", path)
+					die("matching include/exclude patterns against", path, err)
+				}
+				if matched {
+					debug("skipping", path, "(excluded)")
+					// An exclude only means "leave this out of the new
+					// archive", not "delete it from a prior incremental
+					// extraction" -- mark it (and, for a directory, every
+					// base path below it, since WalkDir may not visit them)
+					// as seen so it isn't whiteouted out from under an
+					// existing deployment.
+					if baseEntries != nil {
+						markSeenUnderPath(baseEntries, seen, path)
+					}
+					// A "!" pattern (every -include is one) may still
+					// re-include something below an excluded directory, so
+					// the subtree is only skipped when there are none.
+					if d.IsDir() && !matcher.Exclusions() {
+						return fs.SkipDir
+					}
+					return nil
 				}
-				hdr.Linkname = target
-			case 0: // regular file
-				hdr.Typeflag = tar.TypeReg
-				hdr.Size = info.Size()
-			default:
-				die("unsupported file type:", path)
-			}
-
-			err = tarWrt.WriteHeader(&hdr)
-			if err != nil {
-				die("writing tar header of file:", path)
 			}
 
-			if mode.Type() == 0 {
-				wf, err := os.Open(filepath.Join(cd, path))
-				if err != nil {
-					die("opening file:", path)
-				}
-				_, err = io.Copy(tarWrt, wf)
-				if err != nil {
-					die("writing file to tar:", path)
+			if baseEntries != nil {
+				seen[path] = true
+				if base, ok := baseEntries[path]; ok {
+					unchanged, err := unchangedSinceBase(cd, path, base)
+					if err != nil {
+						die("comparing", path, "to base archive:", err)
+					}
+					if unchanged {
+						debug("skipping", path, "(unchanged since base)")
+						return nil
+					}
 				}
-				wf.Close()
 			}
 
+			archiveEntry(tarWrt, cd, path, uidMap, gidMap)
 			return nil
 		})
 	}
 
+	if manifest != "" {
+		addManifestEntries(tarWrt, cd, manifest, uidMap, gidMap, seen)
+	}
+
+	if baseEntries != nil {
+		for path := range baseEntries {
+			if !seen[path] {
+				debug("removed since base:", path)
+				if err := writeWhiteout(tarWrt, path); err != nil {
+					die("writing whiteout for", path, ":", err)
+				}
+			}
+		}
+	}
+
 	err = tarWrt.Close()
 	if err != nil {
 		die("closing tar:", err)
 	}
-	err = zWrt.Close()
+	err = cWrt.Close()
+	if err != nil {
+		die("closing", codec.Name(), "compressor:", err)
+	}
+	err = encWrt.Close()
 	if err != nil {
-		die("closing zstd:", err)
+		die("closing payload encryption:", err)
+	}
+	err = writeTrailer(f, payloadOffset, newKey, codec.Tag(), parentKey)
+	if err != nil {
+		die("writing trailer to output file:", err)
 	}
 	err = f.Chmod(0755)
 	if err != nil {
@@ -120,3 +171,150 @@ func create(stub, key []byte, out string, files []string, cd string) {
 		die("closing output file:", err)
 	}
 }
+
+// setOwnerAndTimes populates hdr's ownership and timestamps from info, then
+// remaps uid/gid through uidMap/gidMap so an archive built as root can be
+// embedded with the ids its eventual unprivileged extraction is meant to see.
+func setOwnerAndTimes(hdr *tar.Header, info fs.FileInfo, uidMap, gidMap idmap.Map) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		hdr.ModTime = info.ModTime()
+		return
+	}
+
+	hdr.Uid = int(stat.Uid)
+	hdr.Gid = int(stat.Gid)
+	hdr.ModTime = time.Unix(int64(stat.Mtim.Sec), int64(stat.Mtim.Nsec))
+	hdr.AccessTime = time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec))
+
+	if u, err := user.LookupId(strconv.Itoa(hdr.Uid)); err == nil {
+		hdr.Uname = u.Username
+	}
+	if g, err := user.LookupGroupId(strconv.Itoa(hdr.Gid)); err == nil {
+		hdr.Gname = g.Name
+	}
+
+	if mapped, ok := uidMap.Apply(hdr.Uid); ok {
+		hdr.Uid = mapped
+	}
+	if mapped, ok := gidMap.Apply(hdr.Gid); ok {
+		hdr.Gid = mapped
+	}
+}
+
+// buildMatcher returns a patternmatcher.PatternMatcher implementing -include/
+// -exclude precedence: excludes are passed through as-is, while includes are
+// turned into an initial "exclude everything, then re-include the given
+// patterns" pair ("**", "!pattern", ...) so an explicit -include still loses
+// to a later, more specific -exclude, matching patternmatcher's own
+// last-match-wins semantics. It returns nil when no filtering was requested,
+// so callers can skip matching entirely.
+func buildMatcher(includes, excludes []string) (*patternmatcher.PatternMatcher, error) {
+	if len(includes) == 0 && len(excludes) == 0 {
+		return nil, nil
+	}
+
+	var patterns []string
+	if len(includes) > 0 {
+		patterns = append(patterns, "**")
+		for _, pattern := range includes {
+			patterns = append(patterns, "!"+pattern)
+		}
+	}
+	patterns = append(patterns, excludes...)
+
+	return patternmatcher.New(patterns)
+}
+
+// archiveEntry stats the file at path (relative to cd) and writes it, and its
+// content if it's a regular file, to tarWrt. It's shared between the
+// fs.WalkDir callback and addManifestEntries so a file added through -T is
+// archived identically to one discovered by walking the tree.
+func archiveEntry(tarWrt *tar.Writer, cd, path string, uidMap, gidMap idmap.Map) {
+	debug("archiving", path)
+
+	var hdr tar.Header
+	hdr.Name = path
+
+	info, err := os.Lstat(filepath.Join(cd, path))
+	if err != nil {
+		die("getting info about file:", path)
+	}
+	mode := info.Mode()
+	hdr.Mode = int64(mode)
+
+	switch mode.Type() {
+	case fs.ModeDir:
+		hdr.Typeflag = tar.TypeDir
+	case fs.ModeSymlink:
+		hdr.Typeflag = tar.TypeSymlink
+		target, err := os.Readlink(filepath.Join(cd, path))
+		if err != nil {
+			die("getting target of symlink:", path)
+		}
+		hdr.Linkname = target
+	case 0: // regular file
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = info.Size()
+	default:
+		die("unsupported file type:", path)
+	}
+
+	setOwnerAndTimes(&hdr, info, uidMap, gidMap)
+
+	err = tarWrt.WriteHeader(&hdr)
+	if err != nil {
+		die("writing tar header of file:", path)
+	}
+
+	if mode.Type() == 0 {
+		wf, err := os.Open(filepath.Join(cd, path))
+		if err != nil {
+			die("opening file:", path)
+		}
+		_, err = io.Copy(tarWrt, wf)
+		if err != nil {
+			die("writing file to tar:", path)
+		}
+		wf.Close()
+	}
+}
+
+// markSeenUnderPath marks path, and every key of baseEntries equal to or
+// nested under it, as seen. It's used when a -base diff leaves out a path
+// via -exclude, whose descendants may then never be visited, so none of them
+// are mistaken for a deletion and whiteouted out.
+func markSeenUnderPath(baseEntries map[string]baseEntry, seen map[string]bool, path string) {
+	seen[path] = true
+	prefix := path + string(filepath.Separator)
+	for entry := range baseEntries {
+		if strings.HasPrefix(entry, prefix) {
+			seen[entry] = true
+		}
+	}
+}
+
+// addManifestEntries reads a newline-separated list of paths from the file at
+// manifestPath (like tar -T) and archives each one unconditionally: entries
+// named in the manifest bypass the -include/-exclude matcher entirely, so -T
+// is the one way to force a specific path into the archive regardless of the
+// patterns in effect. When diffing against a base archive (seen non-nil),
+// every manifest path is also marked seen so it isn't mistaken for a deletion.
+func addManifestEntries(tarWrt *tar.Writer, cd, manifestPath string, uidMap, gidMap idmap.Map, seen map[string]bool) {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		die("reading manifest:", err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		path := strings.TrimSpace(line)
+		if path == "" {
+			continue
+		}
+		path = filepath.Clean(path)
+		if seen != nil {
+			seen[path] = true
+		}
+		archiveEntry(tarWrt, cd, path, uidMap, gidMap)
+	}
+}
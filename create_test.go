@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+// TestBuildMatcher covers buildMatcher's precedence: -exclude alone, -include
+// alone (everything else is implicitly excluded), and the two combined,
+// where a later -exclude wins over an earlier -include for the same path.
+func TestBuildMatcher(t *testing.T) {
+	cases := []struct {
+		name     string
+		includes []string
+		excludes []string
+		path     string
+		want     bool // true means path is matched, i.e. excluded from the archive
+	}{
+		{"no patterns", nil, nil, "any/path", false},
+		{"exclude only, matching", nil, []string{"*.log"}, "debug.log", true},
+		{"exclude only, not matching", nil, []string{"*.log"}, "main.go", false},
+		{"include only, matching", []string{"src/**"}, nil, "src/main.go", false},
+		{"include only, not matching", []string{"src/**"}, nil, "docs/readme.md", true},
+		{"include+exclude, exclude wins over include", []string{"src/**"}, []string{"src/*.log"}, "src/debug.log", true},
+		{"include+exclude, include still applies elsewhere", []string{"src/**"}, []string{"src/*.log"}, "src/main.go", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			matcher, err := buildMatcher(c.includes, c.excludes)
+			if err != nil {
+				t.Fatalf("buildMatcher: %v", err)
+			}
+			if matcher == nil {
+				if c.want {
+					t.Fatalf("nil matcher can't match %q, want matched", c.path)
+				}
+				return
+			}
+			got, err := matcher.Matches(c.path)
+			if err != nil {
+				t.Fatalf("Matches(%q): %v", c.path, err)
+			}
+			if got != c.want {
+				t.Fatalf("Matches(%q) = %v, want %v", c.path, got, c.want)
+			}
+		})
+	}
+}
+
+// TestMarkSeenUnderPath checks that marking a path seen also marks every
+// base entry nested under it, which is what keeps an excluded directory from
+// having its descendants whiteouted out.
+func TestMarkSeenUnderPath(t *testing.T) {
+	base := map[string]baseEntry{
+		"dir":          {},
+		"dir/file.txt": {},
+		"dir/sub/a":    {},
+		"other":        {},
+	}
+	seen := map[string]bool{}
+
+	markSeenUnderPath(base, seen, "dir")
+
+	for _, path := range []string{"dir", "dir/file.txt", "dir/sub/a"} {
+		if !seen[path] {
+			t.Errorf("expected %q to be marked seen", path)
+		}
+	}
+	if seen["other"] {
+		t.Errorf("expected %q to be left unmarked", "other")
+	}
+}
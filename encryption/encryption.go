@@ -0,0 +1,252 @@
+// Package encryption wraps a selfextract payload in an authenticated,
+// chunked ChaCha20-Poly1305 stream keyed off the archive's embedded random
+// key, so a payload can't be read with a plain decompressor and any
+// corruption of it is detected. Without a password the key is stored in the
+// archive itself, so anyone who has the archive file can still decrypt it.
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// hkdfInfo namespaces the key derivation so the payload key can never be
+// confused with a key derived from the same secret for another purpose.
+const hkdfInfo = "selfextract-payload-v1"
+
+// chunkSize is the plaintext size of every chunk but the last, which is
+// always strictly shorter (possibly empty): that's what lets Reader tell
+// where the authenticated stream ends without a separate length field, and
+// stops a truncated ciphertext from being mistaken for a complete one.
+const chunkSize = 64 * 1024
+
+const noncePrefixSize = chacha20poly1305.NonceSize - 8 // 8 bytes of big-endian counter
+
+// WrapKey mixes randomKey (the archive's embedded marker) with an optional
+// user passphrase via scrypt. With an empty password it returns randomKey
+// unchanged, giving every archive transparent encryption (integrity, and
+// confidentiality against casual inspection); a password makes decryption
+// additionally require that passphrase.
+func WrapKey(randomKey []byte, password string) ([]byte, error) {
+	if password == "" {
+		return randomKey, nil
+	}
+
+	pepper, err := scrypt.Key([]byte(password), randomKey, 1<<15, 8, 1, len(randomKey))
+	if err != nil {
+		return nil, fmt.Errorf("deriving key from password: %w", err)
+	}
+
+	wrapped := make([]byte, len(randomKey))
+	for i := range wrapped {
+		wrapped[i] = randomKey[i] ^ pepper[i]
+	}
+	return wrapped, nil
+}
+
+// DeriveKey derives the AEAD key used to encrypt/decrypt the payload from the
+// (possibly password-wrapped) key via HKDF-SHA256.
+func DeriveKey(wrappedKey []byte) ([]byte, error) {
+	hk := hkdf.New(sha256.New, wrappedKey, nil, []byte(hkdfInfo))
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hk, key); err != nil {
+		return nil, fmt.Errorf("deriving payload key: %w", err)
+	}
+	return key, nil
+}
+
+// MarkerHash is what gets stored in .selfextract.key instead of the raw key,
+// so that re-running the archive with a different -password also forces a
+// fresh extraction (and thus a decryption attempt that fails loudly) instead
+// of silently reusing a directory extracted under a different passphrase.
+func MarkerHash(wrappedKey []byte) string {
+	sum := sha256.Sum256(wrappedKey)
+	return hex.EncodeToString(sum[:])
+}
+
+// Writer encrypts plaintext written to it into fixed-size authenticated
+// chunks written to the underlying writer, prefixed by a random nonce prefix.
+type Writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint64
+	buf     []byte
+	closed  bool
+}
+
+// NewWriter derives a ChaCha20-Poly1305 AEAD from key and returns a Writer
+// that encrypts everything written to it, in chunkSize plaintext chunks, into
+// w. The caller must call Close to emit the closing chunk.
+func NewWriter(w io.Writer, key []byte) (*Writer, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("generating nonce prefix: %w", err)
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, fmt.Errorf("writing nonce prefix: %w", err)
+	}
+
+	return &Writer{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (cw *Writer) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	copy(nonce, cw.prefix)
+	binary.BigEndian.PutUint64(nonce[noncePrefixSize:], cw.counter)
+	return nonce
+}
+
+// sealChunk encrypts the buffered plaintext as one chunk. final is carried in
+// the AAD so an attacker can't cut the stream short right after a full chunk
+// and pass the truncated stream off as complete.
+func (cw *Writer) sealChunk(final bool) error {
+	aad := []byte{0}
+	if final {
+		aad[0] = 1
+	}
+	ciphertext := cw.aead.Seal(nil, cw.nonce(), cw.buf, aad)
+	cw.counter++
+	cw.buf = cw.buf[:0]
+
+	_, err := cw.w.Write(ciphertext)
+	return err
+}
+
+func (cw *Writer) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		free := chunkSize - len(cw.buf)
+		n := free
+		if n > len(p) {
+			n = len(p)
+		}
+		cw.buf = append(cw.buf, p[:n]...)
+		p = p[n:]
+
+		if len(cw.buf) == chunkSize {
+			if err := cw.sealChunk(false); err != nil {
+				return total - len(p), err
+			}
+		}
+	}
+	return total, nil
+}
+
+// Close flushes any buffered plaintext as the final chunk. It always writes a
+// chunk, possibly empty, so the final chunk is guaranteed to be shorter than
+// a full one and the reader can recognize the end of the stream.
+func (cw *Writer) Close() error {
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+	return cw.sealChunk(true)
+}
+
+// Reader decrypts a stream written by Writer.
+type Reader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint64
+	buf     []byte
+	eof     bool
+	err     error
+}
+
+// NewReader derives the same AEAD as NewWriter and returns a Reader that
+// decrypts the chunked stream read from r, failing on the first chunk whose
+// authentication tag doesn't match.
+func NewReader(r io.Reader, key []byte) (*Reader, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("reading nonce prefix: %w", err)
+	}
+
+	return &Reader{r: r, aead: aead, prefix: prefix}, nil
+}
+
+func (cr *Reader) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	copy(nonce, cr.prefix)
+	binary.BigEndian.PutUint64(nonce[noncePrefixSize:], cr.counter)
+	return nonce
+}
+
+func (cr *Reader) readChunk() error {
+	ciphertext := make([]byte, chunkSize+chacha20poly1305.Overhead)
+	n, err := io.ReadFull(cr.r, ciphertext)
+
+	final := false
+	switch err {
+	case nil:
+		// a full chunk was read, it's not (yet) the final one
+	case io.ErrUnexpectedEOF:
+		final = true
+		ciphertext = ciphertext[:n]
+	case io.EOF:
+		return fmt.Errorf("encrypted payload ended before its final chunk")
+	default:
+		return err
+	}
+
+	aad := []byte{0}
+	if final {
+		aad[0] = 1
+	}
+	plaintext, err := cr.aead.Open(ciphertext[:0], cr.nonce(), ciphertext, aad)
+	if err != nil {
+		return fmt.Errorf("decrypting payload chunk %d: %w", cr.counter, err)
+	}
+	cr.counter++
+
+	cr.buf = plaintext
+	if final {
+		cr.eof = true
+	}
+	return nil
+}
+
+func (cr *Reader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+
+	for len(cr.buf) == 0 && !cr.eof {
+		if err := cr.readChunk(); err != nil {
+			cr.err = err
+			return 0, err
+		}
+	}
+	if len(cr.buf) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+func (cr *Reader) Close() error {
+	return nil
+}
@@ -0,0 +1,183 @@
+package encryption
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// TestWriterReaderRoundTrip covers the chunk boundary cases that matter for
+// Write/Read framing: empty, smaller than a chunk, exactly one chunk, and
+// spanning multiple chunks.
+func TestWriterReaderRoundTrip(t *testing.T) {
+	key := make([]byte, chacha20poly1305.KeySize)
+
+	sizes := []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 2*chunkSize + 100}
+	for _, size := range sizes {
+		plaintext := bytes.Repeat([]byte{0x42}, size)
+
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, key)
+		if err != nil {
+			t.Fatalf("size %d: NewWriter: %v", size, err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			t.Fatalf("size %d: Write: %v", size, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("size %d: Close: %v", size, err)
+		}
+
+		r, err := NewReader(&buf, key)
+		if err != nil {
+			t.Fatalf("size %d: NewReader: %v", size, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: ReadAll: %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("size %d: round-trip mismatch", size)
+		}
+	}
+}
+
+// TestReaderRejectsTamperedChunk ensures a single flipped ciphertext byte
+// fails authentication instead of being silently accepted.
+func TestReaderRejectsTamperedChunk(t *testing.T) {
+	key := make([]byte, chacha20poly1305.KeySize)
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("tamper me")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := buf.Bytes()
+	tampered[len(tampered)-1] ^= 0xff
+
+	r, err := NewReader(bytes.NewReader(tampered), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Fatal("expected an authentication error, got nil")
+	}
+}
+
+// TestReaderRejectsTruncatedStream ensures cutting the stream right after a
+// full, valid chunk is rejected instead of being mistaken for a short but
+// complete payload.
+func TestReaderRejectsTruncatedStream(t *testing.T) {
+	key := make([]byte, chacha20poly1305.KeySize)
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(bytes.Repeat([]byte{0x7}, chunkSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	truncated := buf.Bytes()[:noncePrefixSize+chunkSize+chacha20poly1305.Overhead]
+
+	r, err := NewReader(bytes.NewReader(truncated), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Fatal("expected a truncation error, got nil")
+	}
+}
+
+// TestWrapKey covers the three cases that matter for archive/password
+// interop: no password leaves the key untouched, a password changes it, and
+// wrapping is deterministic so the same passphrase always derives the same
+// wrapped key for a given archive.
+func TestWrapKey(t *testing.T) {
+	randomKey := bytes.Repeat([]byte{0x9}, 16)
+
+	wrapped, err := WrapKey(randomKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(wrapped, randomKey) {
+		t.Fatal("empty password should leave the key unchanged")
+	}
+
+	a, err := WrapKey(randomKey, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(a, randomKey) {
+		t.Fatal("a password should change the key")
+	}
+
+	b, err := WrapKey(randomKey, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Fatal("wrapping the same key and password twice should be deterministic")
+	}
+
+	c, err := WrapKey(randomKey, "different")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(a, c) {
+		t.Fatal("different passwords should derive different wrapped keys")
+	}
+}
+
+// TestDeriveKey checks DeriveKey produces a correctly sized, deterministic
+// key that still depends on its input.
+func TestDeriveKey(t *testing.T) {
+	k1, err := DeriveKey([]byte("wrapped-key-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(k1) != chacha20poly1305.KeySize {
+		t.Fatalf("got key length %d, want %d", len(k1), chacha20poly1305.KeySize)
+	}
+
+	k2, err := DeriveKey([]byte("wrapped-key-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(k1, k2) {
+		t.Fatal("DeriveKey should be deterministic for the same input")
+	}
+
+	k3, err := DeriveKey([]byte("wrapped-key-b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(k1, k3) {
+		t.Fatal("different wrapped keys should derive different payload keys")
+	}
+}
+
+// TestMarkerHash checks MarkerHash is deterministic and distinguishes
+// different keys, which is what lets a changed -password force a fresh
+// extraction instead of silently reusing one from a different passphrase.
+func TestMarkerHash(t *testing.T) {
+	if MarkerHash([]byte("key-a")) != MarkerHash([]byte("key-a")) {
+		t.Fatal("MarkerHash should be deterministic")
+	}
+	if MarkerHash([]byte("key-a")) == MarkerHash([]byte("key-b")) {
+		t.Fatal("MarkerHash should differ between different keys")
+	}
+}
@@ -2,19 +2,22 @@ package main
 
 import (
 	"archive/tar"
-	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/klauspost/compress/zstd"
+	"github.com/synthesio/selfextract/compression"
+	"github.com/synthesio/selfextract/encryption"
+	"github.com/synthesio/selfextract/idmap"
 )
 
 const keyFileName = ".selfextract.key"
@@ -25,15 +28,35 @@ type selfExtractor struct {
 	tempDir     bool
 	payload     io.ReadCloser
 	key         []byte
+	wrappedKey  []byte
+	codec       compression.Codec
+	password    string
+	parentKey   []byte
+	incremental bool
+	uidMap      idmap.Map
+	gidMap      idmap.Map
+	canChown    bool
 	exitCode    chan int
 }
 
-func extract(payload io.ReadCloser, key []byte) {
+func extract(payload io.ReadCloser, key []byte, codec compression.Codec, password string, parentKey []byte) {
+	wrappedKey, err := encryption.WrapKey(key, password)
+	if err != nil {
+		die("wrapping payload key:", err)
+	}
+
 	se := selfExtractor{
-		payload:  payload,
-		key:      key,
-		exitCode: make(chan int),
+		payload:    payload,
+		key:        key,
+		wrappedKey: wrappedKey,
+		codec:      codec,
+		password:   password,
+		parentKey:  parentKey,
+		canChown:   os.Geteuid() == 0,
+		exitCode:   make(chan int),
 	}
+	se.uidMap = parseEnvIDMap(EnvUIDMap)
+	se.gidMap = parseEnvIDMap(EnvGIDMap)
 	se.setupSignals()
 	se.prepareExtractDir()
 	se.extract()
@@ -43,6 +66,20 @@ func extract(payload io.ReadCloser, key []byte) {
 	os.Exit(exit)
 }
 
+// parseEnvIDMap reads a "from:to:count" id map from env, returning the zero
+// Map (no remapping) when the variable is unset.
+func parseEnvIDMap(env string) idmap.Map {
+	s := os.Getenv(env)
+	if s == "" {
+		return idmap.Map{}
+	}
+	m, err := idmap.Parse(s)
+	if err != nil {
+		die("parsing", env+":", err)
+	}
+	return m
+}
+
 func (se *selfExtractor) setupSignals() {
 	grace := 10 * time.Second
 	if graceStr := os.Getenv(EnvGraceTimeout); graceStr != "" {
@@ -66,12 +103,21 @@ func (se *selfExtractor) setupSignals() {
 }
 
 func (se *selfExtractor) getTarReader() *tar.Reader {
-	zRdr, err := zstd.NewReader(se.payload)
+	payloadKey, err := encryption.DeriveKey(se.wrappedKey)
+	if err != nil {
+		die("deriving payload key:", err)
+	}
+	encRdr, err := encryption.NewReader(se.payload, payloadKey)
 	if err != nil {
-		die("creating zstd reader:", err)
+		die("creating payload decryption:", err)
 	}
 
-	return tar.NewReader(zRdr)
+	cRdr, err := se.codec.NewReader(encRdr)
+	if err != nil {
+		die("creating", se.codec.Name(), "reader:", err)
+	}
+
+	return tar.NewReader(cRdr)
 }
 
 func (se *selfExtractor) prepareExtractDir() {
@@ -131,12 +177,22 @@ func (se *selfExtractor) prepareExtractDir() {
 		die("reading key file (extraction dir must be empty or contain a valid key file):", err)
 	}
 
-	if hex.EncodeToString(se.key) == strings.TrimSpace(string(keyData)) {
+	if encryption.MarkerHash(se.wrappedKey) == strings.TrimSpace(string(keyData)) {
 		debug("extraction dir has matching key")
 		se.skipExtract = true
 		return
 	}
 
+	if se.parentKey != nil {
+		baseWrappedKey, err := encryption.WrapKey(se.parentKey, se.password)
+		if err == nil && encryption.MarkerHash(baseWrappedKey) == strings.TrimSpace(string(keyData)) {
+			debug("extraction dir matches parent key, applying incremental diff in place")
+			se.incremental = true
+			return
+		}
+		debug("extraction dir doesn't match parent key either")
+	}
+
 	debug("key doesn't match, cleaning extraction dir")
 	err = cleanupDir(extractDir)
 	if err != nil {
@@ -180,6 +236,53 @@ func cleanupAndDie(dir string, v ...interface{}) {
 	die(v...)
 }
 
+// safeExtractPath resolves name (a cleaned tar entry name) against
+// se.extractDir and makes sure the result is still lexically contained in it.
+// This is what stops a "tar breakout": entries with ".." components or an
+// absolute name that would otherwise let filepath.Join climb out of the
+// extraction directory.
+//
+// This lexical check, plus safeSymlinkTarget below, is the whole hardening
+// layer: a chroot/pivot_root/unshare(CLONE_NEWNS) re-exec, as Docker's
+// chrootarchive does, would additionally cover a TOCTOU race against a
+// symlink swapped in after validation, but extraction here only ever reads
+// from the embedded payload and writes paths it just validated itself, so
+// there's no concurrent actor to race against. Left out as disproportionate
+// to the threat model; revisit if extraction ever runs against untrusted
+// concurrent filesystem access.
+func (se *selfExtractor) safeExtractPath(name string) (string, error) {
+	if name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) || filepath.IsAbs(name) {
+		return "", fmt.Errorf("entry %q escapes extraction directory", name)
+	}
+
+	pathName := filepath.Join(se.extractDir, name)
+	rel, err := filepath.Rel(se.extractDir, pathName)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("entry %q escapes extraction directory", name)
+	}
+
+	return pathName, nil
+}
+
+// safeSymlinkTarget makes sure linkname, once resolved relative to the
+// directory of pathName (a path already validated by safeExtractPath), still
+// lands inside se.extractDir. Without this check a tar stream can plant a
+// symlink pointing outside the extraction directory and have a later entry
+// write through it.
+func (se *selfExtractor) safeSymlinkTarget(linkname, pathName string) error {
+	if filepath.IsAbs(linkname) {
+		return fmt.Errorf("symlink target %q is absolute", linkname)
+	}
+
+	target := filepath.Join(filepath.Dir(pathName), linkname)
+	rel, err := filepath.Rel(se.extractDir, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("symlink target %q escapes extraction directory", linkname)
+	}
+
+	return nil
+}
+
 func (se *selfExtractor) extract() {
 	debug("using extraction dir", se.extractDir)
 
@@ -190,6 +293,12 @@ func (se *selfExtractor) extract() {
 
 	tarRdr := se.getTarReader()
 
+	// Directory timestamps are restored only after every entry has been
+	// extracted: applying them as each directory is created would have every
+	// file written into it afterward bump its mtime right back to extraction
+	// time.
+	var dirs []dirToRestore
+
 	for {
 		hdr, err := tarRdr.Next()
 		if err == io.EOF {
@@ -203,7 +312,29 @@ func (se *selfExtractor) extract() {
 		if name == "." {
 			continue
 		}
-		pathName := filepath.Join(se.extractDir, name)
+		pathName, err := se.safeExtractPath(name)
+		if err != nil {
+			cleanupAndDie(se.extractDir, "rejecting tar entry:", err)
+		}
+
+		if target, ok := isWhiteout(name); ok {
+			targetPath, err := se.safeExtractPath(target)
+			if err != nil {
+				cleanupAndDie(se.extractDir, "rejecting whiteout entry:", err)
+			}
+			debug("removing", target, "(removed since base)")
+			if err := os.RemoveAll(targetPath); err != nil {
+				cleanupAndDie(se.extractDir, "applying whiteout:", err)
+			}
+			continue
+		}
+
+		if se.incremental {
+			if err := replaceIncrementalMismatch(pathName, hdr.Typeflag); err != nil {
+				cleanupAndDie(se.extractDir, "replacing", pathName, ":", err)
+			}
+		}
+
 		switch hdr.Typeflag {
 		case tar.TypeReg:
 			debug("extracting file", name, "of size", hdr.Size)
@@ -223,6 +354,7 @@ func (se *selfExtractor) extract() {
 			}
 
 			f.Close()
+			se.applyOwnerAndTimes(pathName, hdr, true)
 		case tar.TypeDir:
 			debug("creating directory", name)
 			// We choose to disregard directory permissions and use a default
@@ -230,31 +362,140 @@ func (se *selfExtractor) extract() {
 			// complex to handle, both when extracting and also when cleaning
 			// up the directory.
 			err := os.Mkdir(pathName, 0755)
-			if err != nil {
+			// An incremental diff's directories are merged into whatever the
+			// base extraction already left behind (replaceIncrementalMismatch
+			// has already cleared out anything that wasn't itself a
+			// directory), so a pre-existing directory at this path isn't an
+			// error, only a fresh tree is.
+			if err != nil && !(se.incremental && os.IsExist(err)) {
 				cleanupAndDie(se.extractDir, "creating directory", err)
 			}
+			dirs = append(dirs, dirToRestore{pathName, hdr})
 		case tar.TypeSymlink:
 			debug("creating symlink", name)
-			err := os.Symlink(hdr.Linkname, pathName)
+			err := se.safeSymlinkTarget(hdr.Linkname, pathName)
+			if err != nil {
+				cleanupAndDie(se.extractDir, "rejecting symlink entry:", err)
+			}
+			if se.incremental {
+				// An incremental diff may replace a symlink left by the base
+				// extraction; os.Symlink, unlike os.Create, refuses to do
+				// that itself.
+				if err := os.Remove(pathName); err != nil && !os.IsNotExist(err) {
+					cleanupAndDie(se.extractDir, "replacing symlink", err)
+				}
+			}
+			err = os.Symlink(hdr.Linkname, pathName)
 			if err != nil {
 				cleanupAndDie(se.extractDir, "creating symlink", err)
 			}
+			// os.Chtimes follows symlinks, so only ownership is applied here:
+			// there is no portable way to set mtimes on the link itself.
+			se.applyOwnerAndTimes(pathName, hdr, false)
 		default:
 			cleanupAndDie(se.extractDir, "unsupported file type in tar", hdr.Typeflag)
 		}
 	}
 
+	// Deepest directories first, so restoring a parent's mtime can never be
+	// undone by a child directory still left to process.
+	sort.Slice(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i].pathName, string(filepath.Separator)) > strings.Count(dirs[j].pathName, string(filepath.Separator))
+	})
+	for _, d := range dirs {
+		se.applyOwnerAndTimes(d.pathName, d.hdr, true)
+	}
+
 	se.payload.Close()
 
 	se.createKeyFile()
 }
 
+// dirToRestore pairs a directory's resolved path with its tar header, for the
+// second pass in extract that restores timestamps only after every entry
+// under that directory has already been written.
+type dirToRestore struct {
+	pathName string
+	hdr      *tar.Header
+}
+
+// replaceIncrementalMismatch removes whatever already exists at pathName when
+// its type doesn't match want (the new entry's tar.Typeflag). Without this, a
+// diff that turns a symlink (or directory) left by the base extraction into a
+// regular file would have its content written through the stale symlink by
+// os.Create instead of replacing it -- a silent corruption of whatever that
+// symlink pointed to. Entries that already match in type are left alone here;
+// the per-type handling below (os.Create truncating, or the dedicated
+// symlink-removal/os.IsExist checks) deals with same-type replacement.
+func replaceIncrementalMismatch(pathName string, want byte) error {
+	info, err := os.Lstat(pathName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var got byte
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		got = tar.TypeSymlink
+	case info.IsDir():
+		got = tar.TypeDir
+	default:
+		got = tar.TypeReg
+	}
+
+	if got == want {
+		return nil
+	}
+
+	debug("type changed since base, removing", pathName)
+	return os.RemoveAll(pathName)
+}
+
+// applyOwnerAndTimes restores the uid/gid/mtime/atime recorded in hdr,
+// remapped through se.uidMap/se.gidMap. Lchown is skipped without CAP_CHOWN
+// (i.e. not running as root), since it always fails in that case, but
+// Chtimes needs no special privilege on a file this process just created and
+// is applied regardless, so mtime/atime are preserved for every extraction,
+// not just root's.
+func (se *selfExtractor) applyOwnerAndTimes(pathName string, hdr *tar.Header, setTimes bool) {
+	if se.canChown {
+		uid, gid := hdr.Uid, hdr.Gid
+		if mapped, ok := se.uidMap.Apply(uid); ok {
+			uid = mapped
+		}
+		if mapped, ok := se.gidMap.Apply(gid); ok {
+			gid = mapped
+		}
+
+		err := os.Lchown(pathName, uid, gid)
+		if err != nil {
+			cleanupAndDie(se.extractDir, "setting owner of", pathName, ":", err)
+		}
+	} else {
+		debug("not root, skipping ownership for", pathName)
+	}
+
+	if setTimes && !hdr.ModTime.IsZero() {
+		atime := hdr.AccessTime
+		if atime.IsZero() {
+			atime = hdr.ModTime
+		}
+		err := os.Chtimes(pathName, atime, hdr.ModTime)
+		if err != nil {
+			cleanupAndDie(se.extractDir, "setting timestamps of", pathName, ":", err)
+		}
+	}
+}
+
 func (se *selfExtractor) createKeyFile() {
 	f, err := os.Create(filepath.Join(se.extractDir, keyFileName))
 	if err != nil {
 		die("creating key file:", err)
 	}
-	_, err = f.WriteString(hex.EncodeToString(se.key))
+	_, err = f.WriteString(encryption.MarkerHash(se.wrappedKey))
 	if err != nil {
 		die("writing key file:", err)
 	}
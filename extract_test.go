@@ -0,0 +1,82 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestSafeExtractPath covers the tar-breakout entries rejected by
+// safeExtractPath: dot-dot components and absolute names. None of these
+// touch the filesystem, since the function is pure path arithmetic.
+func TestSafeExtractPath(t *testing.T) {
+	se := &selfExtractor{extractDir: "/tmp/selfextract-test"}
+
+	cases := []struct {
+		name    string
+		rawName string
+		wantErr bool
+	}{
+		{"plain file", "file.txt", false},
+		{"nested file", "subdir/file.txt", false},
+		{"dot-dot alone", "..", true},
+		{"dot-dot prefix", "../escape.txt", true},
+		{"dot-dot deep", "../../../etc/passwd", true},
+		{"dot-dot in the middle nets out inside", "subdir/../file.txt", false},
+		{"dot-dot in the middle escapes", "subdir/../../escape.txt", true},
+		{"absolute path", "/etc/shadow", true},
+		{"absolute path nested", "/etc/cron.d/evil", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			name := filepath.Clean(c.rawName)
+			path, err := se.safeExtractPath(name)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("safeExtractPath(%q) = %q, want error", name, path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("safeExtractPath(%q) unexpected error: %v", name, err)
+			}
+			rel, relErr := filepath.Rel(se.extractDir, path)
+			if relErr != nil || rel == ".." || filepath.IsAbs(rel) {
+				t.Fatalf("safeExtractPath(%q) = %q escapes %q", name, path, se.extractDir)
+			}
+		})
+	}
+}
+
+// TestSafeSymlinkTarget covers the symlink-then-write attack: a tar stream
+// plants a symlink pointing outside the extraction directory, then a later
+// regular-file entry writes through it. safeSymlinkTarget is what rejects the
+// symlink entry itself, before any write can happen.
+func TestSafeSymlinkTarget(t *testing.T) {
+	se := &selfExtractor{extractDir: "/tmp/selfextract-test"}
+
+	cases := []struct {
+		name     string
+		linkname string
+		pathName string
+		wantErr  bool
+	}{
+		{"relative target inside root", "file.txt", filepath.Join(se.extractDir, "link"), false},
+		{"relative target inside root, nested", "../file.txt", filepath.Join(se.extractDir, "subdir/link"), false},
+		{"absolute target", "/etc/passwd", filepath.Join(se.extractDir, "link"), true},
+		{"relative target escaping root", "../../../etc/passwd", filepath.Join(se.extractDir, "link"), true},
+		{"relative target escaping root from nested link", "../../file.txt", filepath.Join(se.extractDir, "subdir/link"), true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := se.safeSymlinkTarget(c.linkname, c.pathName)
+			if c.wantErr && err == nil {
+				t.Fatalf("safeSymlinkTarget(%q, %q) = nil, want error", c.linkname, c.pathName)
+			}
+			if !c.wantErr && err != nil {
+				t.Fatalf("safeSymlinkTarget(%q, %q) unexpected error: %v", c.linkname, c.pathName, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+// Package idmap implements the "from:to:count" uid/gid remapping accepted by
+// create's -uidmap/-gidmap flags and the extractor's SELFEXTRACT_UIDMAP and
+// SELFEXTRACT_GIDMAP environment variables, mirroring Docker's idtools.IDMap.
+package idmap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Map remaps [From, From+Count) to [To, To+Count).
+type Map struct {
+	From  int
+	To    int
+	Count int
+}
+
+// Parse parses the "from:to:count" syntax accepted by -uidmap/-gidmap and the
+// SELFEXTRACT_UIDMAP/SELFEXTRACT_GIDMAP environment variables.
+func Parse(s string) (Map, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return Map{}, fmt.Errorf("invalid id map %q, expected from:to:count", s)
+	}
+
+	var m Map
+	var err error
+	if m.From, err = strconv.Atoi(parts[0]); err != nil {
+		return Map{}, fmt.Errorf("invalid id map %q: %w", s, err)
+	}
+	if m.To, err = strconv.Atoi(parts[1]); err != nil {
+		return Map{}, fmt.Errorf("invalid id map %q: %w", s, err)
+	}
+	if m.Count, err = strconv.Atoi(parts[2]); err != nil {
+		return Map{}, fmt.Errorf("invalid id map %q: %w", s, err)
+	}
+	if m.Count <= 0 {
+		return Map{}, fmt.Errorf("invalid id map %q: count must be positive", s)
+	}
+
+	return m, nil
+}
+
+// Apply remaps id through m. ok is false when id falls outside the mapped
+// range, in which case callers should leave id untouched.
+func (m Map) Apply(id int) (int, bool) {
+	if id < m.From || id >= m.From+m.Count {
+		return 0, false
+	}
+	return m.To + (id - m.From), true
+}
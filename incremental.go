@@ -0,0 +1,173 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/synthesio/selfextract/compression"
+	"github.com/synthesio/selfextract/encryption"
+)
+
+// whiteoutPrefix marks a deleted path in an incremental diff tar, following
+// the OCI image layer spec and containerd's archive package: a zero-byte
+// entry named whiteoutPrefix+basename in the parent directory records that
+// basename was removed since the base archive.
+const whiteoutPrefix = ".wh."
+
+// baseEntry is what create -base remembers about one path in the base
+// archive, just enough to tell whether the same path in the new fileset is
+// unchanged and can be left out of the diff.
+type baseEntry struct {
+	typeflag byte
+	mode     int64
+	linkname string
+	size     int64
+	hash     string // sha256 of content, regular files only
+}
+
+// readBaseArchive opens the archive at path (itself a stub+payload+trailer
+// file produced by create) and returns its embedded key alongside an index of
+// every entry its payload contains, for create -base to diff the new fileset
+// against.
+func readBaseArchive(path, password string) ([]byte, map[string]baseEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	_, payload, key, codecTag, _, ok := readSelfTrailer(f)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: not a selfextract archive (no trailer)", path)
+	}
+
+	codec, err := compression.ByTag(codecTag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrappedKey, err := encryption.WrapKey(key, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	payloadKey, err := encryption.DeriveKey(wrappedKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	encRdr, err := encryption.NewReader(payload, payloadKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cRdr, err := codec.NewReader(encRdr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries := map[string]baseEntry{}
+	tarRdr := tar.NewReader(cRdr)
+	for {
+		hdr, err := tarRdr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		name := filepath.Clean(hdr.Name)
+		if name == "." {
+			continue
+		}
+
+		entry := baseEntry{typeflag: hdr.Typeflag, mode: hdr.Mode, linkname: hdr.Linkname, size: hdr.Size}
+		if hdr.Typeflag == tar.TypeReg {
+			h := sha256.New()
+			if _, err := io.Copy(h, tarRdr); err != nil {
+				return nil, nil, err
+			}
+			entry.hash = hex.EncodeToString(h.Sum(nil))
+		}
+		entries[name] = entry
+	}
+
+	return key, entries, nil
+}
+
+// unchangedSinceBase reports whether the file at path (relative to cd)
+// matches the entry recorded for it in the base archive, so create -base can
+// leave it out of the diff tar entirely.
+func unchangedSinceBase(cd, path string, base baseEntry) (bool, error) {
+	info, err := os.Lstat(filepath.Join(cd, path))
+	if err != nil {
+		return false, err
+	}
+
+	var typeflag byte
+	switch info.Mode().Type() {
+	case os.ModeDir:
+		typeflag = tar.TypeDir
+	case os.ModeSymlink:
+		typeflag = tar.TypeSymlink
+	case 0:
+		typeflag = tar.TypeReg
+	default:
+		return false, nil
+	}
+	if typeflag != base.typeflag || int64(info.Mode()) != base.mode {
+		return false, nil
+	}
+
+	switch typeflag {
+	case tar.TypeDir:
+		return true, nil
+	case tar.TypeSymlink:
+		target, err := os.Readlink(filepath.Join(cd, path))
+		if err != nil {
+			return false, err
+		}
+		return target == base.linkname, nil
+	default: // regular file
+		if info.Size() != base.size {
+			return false, nil
+		}
+		f, err := os.Open(filepath.Join(cd, path))
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return false, err
+		}
+		return hex.EncodeToString(h.Sum(nil)) == base.hash, nil
+	}
+}
+
+// writeWhiteout records name's removal since the base archive as a zero-byte
+// ".wh.<basename>" entry in its parent directory, per the OCI whiteout
+// convention applied by selfExtractor.extract on the way back out.
+func writeWhiteout(tarWrt *tar.Writer, name string) error {
+	whiteoutName := filepath.Join(filepath.Dir(name), whiteoutPrefix+filepath.Base(name))
+	return tarWrt.WriteHeader(&tar.Header{
+		Name:     whiteoutName,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     0,
+	})
+}
+
+// isWhiteout reports whether name is a whiteout entry, and if so the sibling
+// path it records the removal of.
+func isWhiteout(name string) (string, bool) {
+	base := filepath.Base(name)
+	if !strings.HasPrefix(base, whiteoutPrefix) {
+		return "", false
+	}
+	return filepath.Join(filepath.Dir(name), strings.TrimPrefix(base, whiteoutPrefix)), true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWriteWhiteoutIsWhiteoutRoundTrip checks that a whiteout entry written
+// by writeWhiteout is recognized by isWhiteout as recording the removal of
+// the original path, including when the path is nested.
+func TestWriteWhiteoutIsWhiteoutRoundTrip(t *testing.T) {
+	cases := []string{"file.txt", "dir/file.txt", "deep/nested/dir/file.txt"}
+
+	for _, path := range cases {
+		t.Run(path, func(t *testing.T) {
+			var buf bytes.Buffer
+			tarWrt := tar.NewWriter(&buf)
+			if err := writeWhiteout(tarWrt, path); err != nil {
+				t.Fatalf("writeWhiteout(%q): %v", path, err)
+			}
+			if err := tarWrt.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			tarRdr := tar.NewReader(&buf)
+			hdr, err := tarRdr.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			removed, ok := isWhiteout(hdr.Name)
+			if !ok {
+				t.Fatalf("isWhiteout(%q) = false, want true", hdr.Name)
+			}
+			if removed != path {
+				t.Fatalf("isWhiteout(%q) = %q, want %q", hdr.Name, removed, path)
+			}
+		})
+	}
+}
+
+// TestIsWhiteoutRejectsOrdinaryEntries checks isWhiteout doesn't mistake a
+// plain file or directory entry for a whiteout.
+func TestIsWhiteoutRejectsOrdinaryEntries(t *testing.T) {
+	for _, name := range []string{"file.txt", "dir/file.txt", "whiteout-but-not-really.txt"} {
+		if _, ok := isWhiteout(name); ok {
+			t.Errorf("isWhiteout(%q) = true, want false", name)
+		}
+	}
+}
+
+// TestUnchangedSinceBase covers the comparisons unchangedSinceBase makes
+// against a base archive entry: identical regular file content, changed
+// content, and a type change (file replaced by a directory).
+func TestUnchangedSinceBase(t *testing.T) {
+	cd := t.TempDir()
+	if err := os.WriteFile(filepath.Join(cd, "file.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	base := baseEntry{typeflag: tar.TypeReg, mode: 0644, size: 5, hash: sha256Hex("hello")}
+
+	unchanged, err := unchangedSinceBase(cd, "file.txt", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unchanged {
+		t.Fatal("expected identical content to be reported unchanged")
+	}
+
+	if err := os.WriteFile(filepath.Join(cd, "file.txt"), []byte("goodbye"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unchanged, err = unchangedSinceBase(cd, "file.txt", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unchanged {
+		t.Fatal("expected changed content to be reported changed")
+	}
+
+	if err := os.Mkdir(filepath.Join(cd, "wasfile"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fileBase := baseEntry{typeflag: tar.TypeReg, mode: 0644, size: 0, hash: sha256Hex("")}
+	unchanged, err = unchangedSinceBase(cd, "wasfile", fileBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unchanged {
+		t.Fatal("expected a type change (file to directory) to be reported changed")
+	}
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha512"
+	"encoding/binary"
 	"encoding/hex"
 	"flag"
 	"fmt"
@@ -12,6 +13,9 @@ import (
 	"os"
 	"strings"
 	"time"
+
+	"github.com/synthesio/selfextract/compression"
+	"github.com/synthesio/selfextract/idmap"
 )
 
 var verbose bool
@@ -22,6 +26,9 @@ const (
 	EnvStartup      = "SELFEXTRACT_STARTUP"
 	EnvExtractOnly  = "SELFEXTRACT_EXTRACT_ONLY"
 	EnvGraceTimeout = "SELFEXTRACT_GRACE_TIMEOUT"
+	EnvUIDMap       = "SELFEXTRACT_UIDMAP"
+	EnvGIDMap       = "SELFEXTRACT_GIDMAP"
+	EnvPassword     = "SELFEXTRACT_PASSWORD"
 )
 
 func init() {
@@ -29,10 +36,14 @@ func init() {
 }
 
 func main() {
-	stub, payload, key := readSelf()
+	stub, payload, key, codecTag, parentKey := readSelf()
 
 	if payload != nil {
-		extract(payload, key)
+		codec, err := compression.ByTag(codecTag)
+		if err != nil {
+			die("unknown payload compression:", err)
+		}
+		extract(payload, key, codec, os.Getenv(EnvPassword), parentKey)
 		return
 	}
 
@@ -42,11 +53,61 @@ func main() {
 	}
 	createName := flag.String("f", "selfextract.out", "name of the archive to create")
 	changeDir := flag.String("C", ".", "change dir before archiving files, only affects input files")
+	codecName := flag.String("z", compression.Zstd.Name(), "payload compression: zstd, gzip, xz or none")
+	level := flag.Int("L", 0, "compression level, meaning depends on -z; 0 picks each codec's default")
+	uidMapFlg := flag.String("uidmap", "", "remap uid from:to:count when archiving, mirroring Docker's idtools.IDMap")
+	gidMapFlg := flag.String("gidmap", "", "remap gid from:to:count when archiving, mirroring Docker's idtools.IDMap")
+	password := flag.String("password", "", "passphrase required to decrypt the payload, in addition to the embedded key")
+	var includes, excludes stringList
+	flag.Var(&includes, "include", "only archive paths matching this pattern (patternmatcher/.dockerignore syntax, repeatable)")
+	flag.Var(&excludes, "exclude", "skip paths matching this pattern (patternmatcher/.dockerignore syntax, repeatable); takes precedence over -include")
+	manifest := flag.String("T", "", "read an explicit newline-separated list of paths to archive from this file, like tar -T; bypasses -include/-exclude")
+	baseArchive := flag.String("base", "", "previous archive to diff against, writing an OCI-style incremental diff tar instead of a full one")
 	verboseFlg := flag.Bool("v", false, "verbose output")
 	flag.Parse()
 	verbose = verbose || *verboseFlg
 
-	create(stub, key, *createName, flag.Args(), *changeDir)
+	codec, err := compression.ByName(*codecName)
+	if err != nil {
+		die(err)
+	}
+
+	uidMap, err := parseFlagIDMap(*uidMapFlg)
+	if err != nil {
+		die("-uidmap:", err)
+	}
+	gidMap, err := parseFlagIDMap(*gidMapFlg)
+	if err != nil {
+		die("-gidmap:", err)
+	}
+
+	create(stub, key, *createName, flag.Args(), *changeDir, codec, *level, uidMap, gidMap, *password, includes, excludes, *manifest, *baseArchive)
+}
+
+// stringList implements flag.Value to accept a flag multiple times, appending
+// each occurrence instead of keeping only the last one, as used by -include
+// and -exclude.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// parseFlagIDMap parses the -uidmap/-gidmap flags, treating an empty value as
+// "no remapping" instead of a parse error.
+func parseFlagIDMap(s string) (idmap.Map, error) {
+	if s == "" {
+		return idmap.Map{}, nil
+	}
+	return idmap.Parse(s)
 }
 
 func debug(v ...interface{}) {
@@ -86,12 +147,59 @@ func generateRandomKey() []byte {
 	return buf
 }
 
-// maxBoundaryOffset is the offset at which we stop looking for a boundary,
-// it's just a failsafe mechanism against big, corrupted archives. We set it to
-// a value much bigger than the expected size of the compiled stub.
+// maxBoundaryOffset is the offset at which we stop looking for a boundary in
+// the legacy (pre-trailer) layout, it's just a failsafe mechanism against big,
+// corrupted archives. We set it to a value much bigger than the expected size
+// of the compiled stub.
 const maxBoundaryOffset = 100e6 // 100 MB
 
-func readSelf() ([]byte, io.ReadCloser, []byte) {
+// trailerMagic identifies the trailer appended by create after the payload.
+// It is written both before and after the fixed-size fields so readSelf can
+// validate the trailer without first knowing the stub or payload size.
+const trailerMagic = "SELFXTR1" // 8 bytes
+
+// trailerFooterMagic marks the self-describing trailer footer introduced
+// below, distinct from trailerMagic so readSelfTrailer can tell a versioned
+// trailer apart from one of the fixed-size layouts that came before it.
+const trailerFooterMagic = "SELFXFT1" // 8 bytes
+
+// trailerFooterSize is
+// [footer magic][version byte][body length uint32 BE][magic], written after
+// the trailer body by every create since this scheme was introduced. Its
+// shape never changes again: growing the trailer means teaching
+// parseTrailerBody a new version, not touching the footer.
+const trailerFooterSize = len(trailerFooterMagic) + 1 + 4 + len(trailerMagic)
+
+// currentTrailerVersion is the trailer body layout written by this build of
+// create. Bump it, and add a case to parseTrailerBody, whenever the body
+// grows again.
+const currentTrailerVersion = 1
+
+// Fixed trailer sizes written by create before the self-describing footer
+// existed, tried by readSelfTrailerLegacy newest first. None of these carry a
+// version of their own, which is exactly the problem the footer above fixes.
+const (
+	legacyTrailerSizeV1 = len(trailerMagic) + 8 + keyLength + len(trailerMagic)                     // no codec tag, no parent key
+	legacyTrailerSizeV2 = len(trailerMagic) + 8 + keyLength + 1 + len(trailerMagic)                 // + codec tag
+	legacyTrailerSizeV3 = len(trailerMagic) + 8 + keyLength + 1 + 1 + keyLength + len(trailerMagic) // + has-parent + parent key
+)
+
+// sectionReader exposes the payload bytes of the self file, stopping before
+// the trailing trailer, while closing the underlying file once done with it.
+type sectionReader struct {
+	io.Reader
+	self *os.File
+}
+
+func (s *sectionReader) Close() error {
+	return s.self.Close()
+}
+
+// readSelf returns the compiled stub, the embedded payload (nil when the
+// binary hasn't had one embedded yet), the payload's decryption key, the tag
+// of the codec used to compress it, and the embedded key of the base archive
+// it was diffed against by create -base (nil for a full, standalone payload).
+func readSelf() ([]byte, io.ReadCloser, []byte, byte, []byte) {
 	t := time.Now()
 	self, err := os.Open(os.Args[0])
 	if err != nil {
@@ -99,7 +207,170 @@ func readSelf() ([]byte, io.ReadCloser, []byte) {
 	}
 	debug("opened itself in", time.Since(t))
 
-	t = time.Now()
+	if stub, payload, key, codecTag, parentKey, ok := readSelfTrailer(self); ok {
+		return stub, payload, key, codecTag, parentKey
+	}
+
+	stub, payload, key, codecTag := readSelfBoundaryScan(self)
+	return stub, payload, key, codecTag, nil
+}
+
+// readSelfTrailer looks for the self-describing trailer written by create at
+// the end of the file. When found, it locates stub and payload in O(1)
+// instead of scanning the file for a boundary, which lets payloads (and the
+// stub) grow past the old 100 MB ceiling. Trailers written before this
+// versioning scheme existed are recognized by readSelfTrailerLegacy instead,
+// so rebuilding create never strands archives made by the previous build.
+func readSelfTrailer(self *os.File) ([]byte, io.ReadCloser, []byte, byte, []byte, bool) {
+	stat, err := self.Stat()
+	if err != nil {
+		die("stating itself:", err)
+	}
+	size := stat.Size()
+	if size < int64(trailerFooterSize) {
+		return nil, nil, nil, 0, nil, false
+	}
+
+	t := time.Now()
+	footer := make([]byte, trailerFooterSize)
+	_, err = self.ReadAt(footer, size-int64(trailerFooterSize))
+	if err != nil {
+		die("reading trailer footer:", err)
+	}
+	debug("trailer footer read in", time.Since(t))
+
+	fmLen := len(trailerFooterMagic)
+	tmLen := len(trailerMagic)
+	if string(footer[:fmLen]) != trailerFooterMagic || string(footer[len(footer)-tmLen:]) != trailerMagic {
+		debug("no versioned trailer, trying legacy fixed-size layouts")
+		return readSelfTrailerLegacy(self, size)
+	}
+
+	version := footer[fmLen]
+	bodyLen := int64(binary.BigEndian.Uint32(footer[fmLen+1 : fmLen+5]))
+	if bodyLen < int64(tmLen) || bodyLen+int64(trailerFooterSize) > size {
+		debug("versioned trailer has an implausible body length", bodyLen)
+		return readSelfTrailerLegacy(self, size)
+	}
+
+	bodyOff := size - int64(trailerFooterSize) - bodyLen
+	leading := make([]byte, bodyLen)
+	_, err = self.ReadAt(leading, bodyOff)
+	if err != nil {
+		die("reading trailer body:", err)
+	}
+	if string(leading[:tmLen]) != trailerMagic {
+		debug("versioned trailer body missing its leading magic")
+		return readSelfTrailerLegacy(self, size)
+	}
+
+	payloadOff, key, codecTag, parentKey, ok := parseTrailerBody(version, leading[tmLen:])
+	if !ok {
+		debug("unrecognized trailer version", version)
+		return readSelfTrailerLegacy(self, size)
+	}
+	debug("trailer v", version, "found, payload offset", payloadOff, "key:", hex.EncodeToString(key))
+
+	return finishReadingTrailer(self, payloadOff, bodyOff, key, codecTag, parentKey)
+}
+
+// parseTrailerBody decodes the part of the trailer body that follows its
+// leading trailerMagic, according to version. Only version 1 (the layout
+// currentTrailerVersion writes today) exists so far; growing the trailer
+// again means adding a case here, not changing trailerFooterSize or
+// reinterpreting version 1's layout.
+func parseTrailerBody(version byte, body []byte) (payloadOff int64, key []byte, codecTag byte, parentKey []byte, ok bool) {
+	switch version {
+	case 1:
+		if len(body) != 8+keyLength+1+1+keyLength {
+			return 0, nil, 0, nil, false
+		}
+		payloadOff = int64(binary.BigEndian.Uint64(body[0:8]))
+		key = body[8 : 8+keyLength]
+		codecTag = body[8+keyLength]
+		if body[8+keyLength+1] != 0 {
+			parentKey = body[8+keyLength+2 : 8+keyLength+2+keyLength]
+		}
+		return payloadOff, key, codecTag, parentKey, true
+	default:
+		return 0, nil, 0, nil, false
+	}
+}
+
+// readSelfTrailerLegacy tries the fixed trailer sizes written by create
+// before trailers carried their own version and length, newest first. It's
+// what lets an archive made by an older build of create keep working after
+// create itself is rebuilt with a bigger trailer.
+func readSelfTrailerLegacy(self *os.File, size int64) ([]byte, io.ReadCloser, []byte, byte, []byte, bool) {
+	magicLen := len(trailerMagic)
+
+	for _, sz := range []int{legacyTrailerSizeV3, legacyTrailerSizeV2, legacyTrailerSizeV1} {
+		if size < int64(sz) {
+			continue
+		}
+
+		trailer := make([]byte, sz)
+		_, err := self.ReadAt(trailer, size-int64(sz))
+		if err != nil {
+			die("reading trailer:", err)
+		}
+
+		if string(trailer[:magicLen]) != trailerMagic || string(trailer[sz-magicLen:]) != trailerMagic {
+			continue
+		}
+
+		payloadOff := int64(binary.BigEndian.Uint64(trailer[magicLen : magicLen+8]))
+		key := trailer[magicLen+8 : magicLen+8+keyLength]
+		var codecTag byte
+		var parentKey []byte
+		switch sz {
+		case legacyTrailerSizeV3:
+			codecTag = trailer[magicLen+8+keyLength]
+			if trailer[magicLen+8+keyLength+1] != 0 {
+				parentKey = trailer[magicLen+8+keyLength+2 : magicLen+8+keyLength+2+keyLength]
+			}
+		case legacyTrailerSizeV2:
+			codecTag = trailer[magicLen+8+keyLength]
+		default: // legacyTrailerSizeV1
+			codecTag = compression.Zstd.Tag()
+		}
+		debug("legacy trailer found (size", sz, "), payload offset", payloadOff, "key:", hex.EncodeToString(key))
+
+		return finishReadingTrailer(self, payloadOff, size-int64(sz), key, codecTag, parentKey)
+	}
+
+	debug("no trailer")
+	return nil, nil, nil, 0, nil, false
+}
+
+// finishReadingTrailer reads the stub and sets up the payload reader shared
+// by both the versioned and legacy trailer paths, once each has located the
+// payload offset and the byte at which the trailer itself begins.
+func finishReadingTrailer(self *os.File, payloadOff, trailerOff int64, key []byte, codecTag byte, parentKey []byte) ([]byte, io.ReadCloser, []byte, byte, []byte, bool) {
+	stub := make([]byte, payloadOff)
+	_, err := self.ReadAt(stub, 0)
+	if err != nil {
+		die("reading stub:", err)
+	}
+
+	_, err = self.Seek(payloadOff, io.SeekStart)
+	if err != nil {
+		die("seeking to start of payload:", err)
+	}
+
+	payloadSize := trailerOff - payloadOff
+	payload := &sectionReader{io.LimitReader(self, payloadSize), self}
+
+	return stub, payload, key, codecTag, parentKey, true
+}
+
+// readSelfBoundaryScan is the legacy lookup, kept so archives created before
+// the trailer format was introduced keep working: it scans for the sha512
+// "boundary" marker instead of reading it straight from a trailer. These
+// archives predate the trailer's codec tag, so the codec is recovered by
+// sniffing the payload's leading bytes with compression.Detect instead.
+func readSelfBoundaryScan(self *os.File) ([]byte, io.ReadCloser, []byte, byte) {
+	t := time.Now()
 	buf := make([]byte, maxBoundaryOffset+keyLength)
 	n, err := self.Read(buf)
 	var bufFull bool
@@ -122,7 +393,7 @@ func readSelf() ([]byte, io.ReadCloser, []byte) {
 		}
 		debug("no boundary")
 		self.Close()
-		return buf, nil, nil
+		return buf, nil, nil, 0
 	}
 	debug("boundary found at", bdyOff)
 
@@ -137,5 +408,55 @@ func readSelf() ([]byte, io.ReadCloser, []byte) {
 	}
 	buf = buf[:bdyOff]
 
-	return buf, self, key
+	// ReadAt doesn't disturb the offset we just Seek'd to, so self can still
+	// be handed back as a stream starting exactly at payloadOff.
+	head := make([]byte, 16)
+	n, err = self.ReadAt(head, int64(payloadOff))
+	if err != nil && err != io.EOF {
+		die("peeking payload for compression detection:", err)
+	}
+	codec := compression.Detect(head[:n])
+	debug("detected payload compression:", codec.Name())
+
+	return buf, self, key, codec.Tag()
+}
+
+// writeTrailer appends the self-describing trailer after the payload, so
+// readSelf can jump straight to payloadOffset instead of scanning the file
+// for a boundary. parentKey is the base archive's embedded key when this
+// payload is an incremental diff written by create -base, and nil for a
+// full, standalone archive.
+//
+// The trailer is [magic][body][footer magic][version][length][magic], where
+// length covers the leading magic plus body: body carries
+// currentTrailerVersion's fields, and the footer lets a future
+// build of create grow the body without losing the ability to read a
+// trailer written by this one -- see parseTrailerBody and
+// readSelfTrailerLegacy.
+func writeTrailer(w io.Writer, payloadOffset int64, key []byte, codecTag byte, parentKey []byte) error {
+	magicLen := len(trailerMagic)
+	body := make([]byte, 8+keyLength+1+1+keyLength)
+	binary.BigEndian.PutUint64(body[0:8], uint64(payloadOffset))
+	copy(body[8:8+keyLength], key)
+	body[8+keyLength] = codecTag
+	if parentKey != nil {
+		body[8+keyLength+1] = 1
+		copy(body[8+keyLength+2:8+keyLength+2+keyLength], parentKey)
+	}
+
+	leading := make([]byte, magicLen+len(body))
+	copy(leading, trailerMagic)
+	copy(leading[magicLen:], body)
+
+	footer := make([]byte, trailerFooterSize)
+	n := copy(footer, trailerFooterMagic)
+	footer[n] = currentTrailerVersion
+	binary.BigEndian.PutUint32(footer[n+1:n+5], uint32(len(leading)))
+	copy(footer[n+5:], trailerMagic)
+
+	if _, err := w.Write(leading); err != nil {
+		return err
+	}
+	_, err := w.Write(footer)
+	return err
 }